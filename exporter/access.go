@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// updateAccountAccessServiceTokens exports the time remaining until each
+// Access service token expires, rather than the raw expiry timestamp, so
+// alerting on "expires in < 14d" is a single PromQL comparison instead of a
+// time() subtraction in every rule.
+func (cm *CloudflareMetrics) updateAccountAccessServiceTokens(accountId string) {
+	var accessServiceTokens []cloudflare.AccessServiceToken
+	err := cm.withRateLimit(accountId, "AccessServiceTokens", func() error {
+		var apiErr error
+		accessServiceTokens, _, apiErr = cm.api.AccessServiceTokens(context.Background(), accountId)
+		return apiErr
+	})
+	if err != nil {
+		log.Printf("cloudflare.API.AccessServiceTokens(%v): %v\n", accountId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	now := time.Now()
+	for _, token := range accessServiceTokens {
+		labels := prometheus.Labels{"account_id": accountId, "token_name": token.Name}
+		cm.createGaugeIfNotExists("cloudflare_access_service_token_expires_in_seconds", "Seconds until an Access service token expires; negative if it already has", labels).With(labels).Set(token.ExpiresAt.Sub(now).Seconds())
+	}
+}
+
+// updateAccountAccessApplications walks the account's Access applications,
+// exporting one info gauge per application and its policies.
+func (cm *CloudflareMetrics) updateAccountAccessApplications(accountId string) {
+	var applications []cloudflare.AccessApplication
+	err := cm.withRateLimit(accountId, "AccessApplications", func() error {
+		var apiErr error
+		applications, _, apiErr = cm.api.AccessApplications(context.Background(), accountId, cloudflare.PaginationOptions{})
+		return apiErr
+	})
+	if err != nil {
+		log.Printf("cloudflare.API.AccessApplications(%v): %v\n", accountId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	for _, app := range applications {
+		labels := prometheus.Labels{
+			"account_id":       accountId,
+			"app_id":           app.ID,
+			"domain":           app.Domain,
+			"type":             string(app.Type),
+			"session_duration": app.SessionDuration,
+		}
+		cm.createGaugeIfNotExists("cloudflare_access_application_info", "Static information about a Cloudflare Access application; value is always 1", labels).With(labels).Set(1)
+
+		cm.updateAccountAccessPolicies(accountId, app.ID)
+	}
+}
+
+// updateAccountAccessPolicies exports one info gauge per Access policy
+// attached to the given application.
+func (cm *CloudflareMetrics) updateAccountAccessPolicies(accountId string, appId string) {
+	var policies []cloudflare.AccessPolicy
+	err := cm.withRateLimit(accountId, "AccessPolicies", func() error {
+		var apiErr error
+		policies, _, apiErr = cm.api.AccessPolicies(context.Background(), accountId, appId, cloudflare.PaginationOptions{})
+		return apiErr
+	})
+	if err != nil {
+		log.Printf("cloudflare.API.AccessPolicies(%v, %v): %v\n", accountId, appId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	for _, policy := range policies {
+		labels := prometheus.Labels{
+			"app_id":     appId,
+			"policy_id":  policy.ID,
+			"decision":   policy.Decision,
+			"precedence": strconv.Itoa(policy.Precedence),
+		}
+		cm.createGaugeIfNotExists("cloudflare_access_policy_info", "Static information about a Cloudflare Access policy; value is always 1", labels).With(labels).Set(1)
+	}
+}
+
+// updateAccountAccessIdentityProviders exports how many identity providers
+// of each type are configured for the account.
+func (cm *CloudflareMetrics) updateAccountAccessIdentityProviders(accountId string) {
+	var idps []cloudflare.AccessIdentityProvider
+	err := cm.withRateLimit(accountId, "AccessIdentityProviders", func() error {
+		var apiErr error
+		idps, apiErr = cm.api.AccessIdentityProviders(context.Background(), accountId)
+		return apiErr
+	})
+	if err != nil {
+		log.Printf("cloudflare.API.AccessIdentityProviders(%v): %v\n", accountId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	counts := map[string]int{}
+	for _, idp := range idps {
+		counts[idp.Type]++
+	}
+	for idpType, count := range counts {
+		labels := prometheus.Labels{"account_id": accountId, "type": idpType}
+		cm.createGaugeIfNotExists("cloudflare_access_identity_providers_total", "Number of Access identity providers configured for an account, by type", labels).With(labels).Set(float64(count))
+	}
+}
+
+// updateAccountAccessOrganization exports the account's Access organization
+// (tenant) settings.
+func (cm *CloudflareMetrics) updateAccountAccessOrganization(accountId string) {
+	var org cloudflare.AccessOrganization
+	err := cm.withRateLimit(accountId, "AccessOrganization", func() error {
+		var apiErr error
+		org, _, apiErr = cm.api.AccessOrganization(context.Background(), accountId)
+		return apiErr
+	})
+	if err != nil {
+		log.Printf("cloudflare.API.AccessOrganization(%v): %v\n", accountId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	labels := prometheus.Labels{"account_id": accountId, "auth_domain": org.AuthDomain}
+	cm.createGaugeIfNotExists("cloudflare_access_organization_info", "Static information about a Cloudflare Access organization; value is always 1", labels).With(labels).Set(1)
+}
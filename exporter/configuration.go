@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strconv"
 )
 
 func EnvString(key string, fallback string) string {
@@ -11,13 +12,24 @@ func EnvString(key string, fallback string) string {
 	return fallback
 }
 
+func EnvInt(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
 type ExporterConfig struct {
-	cloudflareEmail          string
-	cloudflareKey            string
-	cloudflareToken          string
-	cloudflareUserServiceKey string
-	cloudflareZones          string
-	cloudflareAccounts       string
-	cloudflareSince          string
-	cloudflareIncludeAccess  bool
+	cloudflareEmail           string
+	cloudflareKey             string
+	cloudflareToken           string
+	cloudflareUserServiceKey  string
+	cloudflareZones           string
+	cloudflareAccounts        string
+	cloudflareSince           string
+	cloudflareIncludeAccess   bool
+	cloudflareGraphQLDatasets string
+	cloudflareMaxConcurrency  int
 }
@@ -1,8 +1,15 @@
 package main
 
 import (
-	"gopkg.in/alecthomas/kingpin.v2"
+	"context"
 	"log"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
@@ -10,20 +17,25 @@ var (
 	CLOUDFLARE_TOKEN            = EnvString("CLOUDFLARE_TOKEN", "")            // (optional) token used for Cloudflare API token authentication
 	CLOUDFLARE_USER_SERVICE_KEY = EnvString("CLOUDFLARE_USER_SERVICE_KEY", "") // (optional) key used for Cloudflare API user service key authentication
 
-	cloudflareEmail         = kingpin.Flag("cloudflare.email", "email used for Cloudflare API email authentication, env: CLOUDFLARE_EMAIL").Default(EnvString("CLOUDFLARE_EMAIL", "")).String()
-	cloudflareZones         = kingpin.Flag("cloudflare.zones", "(required) comma-separated list of zone names to scrape for metrics (e.g. 'example.com,example.org'), env: CLOUDFLARE_ZONES").Default(EnvString("CLOUDFLARE_ZONES", "")).String()
-	cloudflareAccounts      = kingpin.Flag("cloudflare.accounts", "comma-separated list of account ids to scrape for metrics (e.g. '123548648,123548644868'), env: CLOUDFLARE_ACCOUNTS").Default(EnvString("CLOUDFLARE_ACCOUNTS", "")).String()
-	cloudflareSince         = kingpin.Flag("cloudflare.since", "`since` parameter of calls to the Cloudflare Analytics API ('Free' tenants have a minimum of 24h), env: CLOUDFLARE_SCRAPE_ANALYTICS_SINCE").Default(EnvString("CLOUDFLARE_SCRAPE_ANALYTICS_SINCE", "24h")).String()
-	cloudflareIncludeAccess = kingpin.Flag("cloudflare.include-access", "bool to enable access-related metrics").Default("false").Bool()
-	exporterListenAddr      = kingpin.Flag("web.listen-addr", "address for the exporter to bind to, env: EXPORTER_LISTEN_ADDR").Default(EnvString("EXPORTER_LISTEN_ADDR", "127.0.0.1:9199")).String()
-	cloudflare_metrics      *CloudflareMetrics
+	cloudflareEmail           = kingpin.Flag("cloudflare.email", "email used for Cloudflare API email authentication, env: CLOUDFLARE_EMAIL").Default(EnvString("CLOUDFLARE_EMAIL", "")).String()
+	cloudflareZones           = kingpin.Flag("cloudflare.zones", "(required unless --config.file is set) comma-separated list of zone names to scrape for metrics (e.g. 'example.com,example.org'), env: CLOUDFLARE_ZONES").Default(EnvString("CLOUDFLARE_ZONES", "")).String()
+	cloudflareAccounts        = kingpin.Flag("cloudflare.accounts", "comma-separated list of account ids to scrape for metrics (e.g. '123548648,123548644868'), env: CLOUDFLARE_ACCOUNTS").Default(EnvString("CLOUDFLARE_ACCOUNTS", "")).String()
+	cloudflareSince           = kingpin.Flag("cloudflare.since", "`since` parameter of calls to the Cloudflare Analytics API ('Free' tenants have a minimum of 24h), env: CLOUDFLARE_SCRAPE_ANALYTICS_SINCE").Default(EnvString("CLOUDFLARE_SCRAPE_ANALYTICS_SINCE", "24h")).String()
+	cloudflareIncludeAccess   = kingpin.Flag("cloudflare.include-access", "bool to enable access-related metrics").Default("false").Bool()
+	cloudflareGraphQLDatasets = kingpin.Flag("cloudflare.graphql-datasets", "comma-separated list of Cloudflare GraphQL Analytics datasets to scrape (e.g. 'httpRequestsAdaptiveGroups,firewallEventsAdaptive,healthCheckEventsAdaptiveGroups'), env: CLOUDFLARE_GRAPHQL_DATASETS").Default(EnvString("CLOUDFLARE_GRAPHQL_DATASETS", "httpRequestsAdaptiveGroups,firewallEventsAdaptive,healthCheckEventsAdaptiveGroups")).String()
+	cloudflareMaxConcurrency  = kingpin.Flag("cloudflare.max-concurrency", "maximum number of zones/accounts to scrape concurrently, env: CLOUDFLARE_MAX_CONCURRENCY").Default(strconv.Itoa(EnvInt("CLOUDFLARE_MAX_CONCURRENCY", 4))).Int()
+	exporterListenAddr        = kingpin.Flag("web.listen-addr", "address for the exporter to bind to, env: EXPORTER_LISTEN_ADDR").Default(EnvString("EXPORTER_LISTEN_ADDR", "127.0.0.1:9199")).String()
+	webConfigFile             = kingpin.Flag("web.config-file", "path to a prometheus/exporter-toolkit web configuration file enabling TLS or basic auth").Default("").String()
+	webEnablePprof            = kingpin.Flag("web.enable-pprof", "expose net/http/pprof endpoints under /debug/pprof").Default("false").Bool()
+	webEnableReload           = kingpin.Flag("web.enable-reload", "expose a /-/reload endpoint that rebuilds the Cloudflare client and metrics from the startup configuration").Default("false").Bool()
+	configFile                = kingpin.Flag("config.file", "path to a YAML file defining named Cloudflare targets, enabling /probe?target=<name> to scrape multiple tenants from one exporter, env: CONFIG_FILE").Default(EnvString("CONFIG_FILE", "")).String()
+
+	cloudflareMetricsMu sync.RWMutex
+	cloudflare_metrics  *CloudflareMetrics
 )
 
-func main() {
-	var err error
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-	config := ExporterConfig{
+func configFromFlags() ExporterConfig {
+	return ExporterConfig{
 		*cloudflareEmail,
 		CLOUDFLARE_KEY,
 		CLOUDFLARE_TOKEN,
@@ -32,12 +44,67 @@ func main() {
 		*cloudflareAccounts,
 		*cloudflareSince,
 		*cloudflareIncludeAccess,
+		*cloudflareGraphQLDatasets,
+		*cloudflareMaxConcurrency,
 	}
-	cloudflare_metrics, err = New(config)
+}
+
+// currentMetrics returns the active *CloudflareMetrics. It's indirected
+// through a lock so /-/reload can swap in a freshly built one without
+// restarting the server.
+func currentMetrics() *CloudflareMetrics {
+	cloudflareMetricsMu.RLock()
+	defer cloudflareMetricsMu.RUnlock()
+	return cloudflare_metrics
+}
+
+// reload rebuilds cloudflare_metrics (fresh API client, registry and gauges)
+// from the configuration parsed at startup, without disturbing in-flight
+// scrapes. Flags and CLOUDFLARE_* environment variables are not re-read.
+func reload() {
+	metrics, err := New(configFromFlags())
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("reload: %v\n", err)
+		return
 	}
+	cloudflareMetricsMu.Lock()
+	cloudflare_metrics = metrics
+	cloudflareMetricsMu.Unlock()
+}
+
+func main() {
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	var multiTarget *MultiTargetConfig
+	if *configFile != "" {
+		loaded, err := loadMultiTargetConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		multiTarget = loaded
+	}
+
+	// The legacy single-target mode (--cloudflare.zones et al., serving
+	// /metrics directly) stays available for back-compat; it's only
+	// required when --config.file isn't in use.
+	if *cloudflareZones != "" {
+		metrics, err := New(configFromFlags())
+		if err != nil {
+			log.Fatal(err)
+		}
+		cloudflare_metrics = metrics
+	} else if multiTarget == nil {
+		log.Fatal(errNoCloudflareZones)
+	}
+
+	server := NewServer(*exporterListenAddr, *webConfigFile, currentMetrics, *webEnablePprof, *webEnableReload, reload, multiTarget)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
 	log.Printf("serving metrics at http://%v/metrics\n", *exporterListenAddr)
-	log.Fatal(ListenAndServe(*exporterListenAddr))
+	if err := server.ListenAndServe(ctx); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
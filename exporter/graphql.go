@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+)
+
+// graphqlClient is a thin client for Cloudflare's GraphQL Analytics API.
+// cloudflare-go does not wrap this endpoint, so we speak it directly over
+// the same *cloudflare.API we already authenticate with.
+type graphqlClient struct {
+	api      *cloudflare.API
+	http     *http.Client
+	datasets []string
+}
+
+func newGraphQLClient(api *cloudflare.API, datasets string) *graphqlClient {
+	return &graphqlClient{
+		api:      api,
+		http:     http.DefaultClient,
+		datasets: strings.Split(strings.ReplaceAll(datasets, " ", ""), ","),
+	}
+}
+
+type graphqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+}
+
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []graphqlError  `json:"errors"`
+}
+
+// query executes a GraphQL query against the Cloudflare Analytics API and
+// returns the raw "data" object, leaving dataset-specific unmarshaling to
+// the caller.
+func (g *graphqlClient) query(query string, variables map[string]interface{}) (json.RawMessage, error) {
+	body, err := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, g.api.BaseURL+"/graphql", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	g.setAuthHeaders(req)
+
+	resp, err := g.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, graphqlHTTPError{StatusCode: resp.StatusCode, Body: string(raw)}
+	}
+
+	var gqlResp graphqlResponse
+	if err := json.Unmarshal(raw, &gqlResp); err != nil {
+		return nil, fmt.Errorf("unmarshal GraphQL response: %w", err)
+	}
+	if len(gqlResp.Errors) > 0 {
+		return nil, fmt.Errorf("cloudflare GraphQL API: %s", gqlResp.Errors[0].Message)
+	}
+
+	return gqlResp.Data, nil
+}
+
+// graphqlHTTPError reports a non-200 from the GraphQL endpoint (most
+// commonly a 401/403 from an expired or under-scoped token), in the same
+// shape cloudflare.APIRequestError exposes so isAuthError can recognize both.
+type graphqlHTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e graphqlHTTPError) Error() string {
+	return fmt.Sprintf("HTTP status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e graphqlHTTPError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+func (g *graphqlClient) setAuthHeaders(req *http.Request) {
+	switch {
+	case g.api.APIToken != "":
+		req.Header.Set("Authorization", "Bearer "+g.api.APIToken)
+	case g.api.APIUserServiceKey != "":
+		req.Header.Set("X-Auth-User-Service-Key", g.api.APIUserServiceKey)
+	default:
+		req.Header.Set("X-Auth-Email", g.api.APIEmail)
+		req.Header.Set("X-Auth-Key", g.api.APIKey)
+	}
+}
+
+// zoneAnalyticsResponse is the shape common to every per-zone Analytics
+// dataset query we issue; only the dataset the query actually asked for
+// will be populated.
+type zoneAnalyticsResponse struct {
+	Viewer struct {
+		Zones []struct {
+			HTTPRequestsAdaptiveGroups      []httpRequestsAdaptiveGroup      `json:"httpRequestsAdaptiveGroups"`
+			FirewallEventsAdaptive          []firewallEventsAdaptiveEvent    `json:"firewallEventsAdaptive"`
+			HealthCheckEventsAdaptiveGroups []healthCheckEventsAdaptiveGroup `json:"healthCheckEventsAdaptiveGroups"`
+		} `json:"zones"`
+	} `json:"viewer"`
+}
+
+type httpRequestsAdaptiveGroup struct {
+	Dimensions struct {
+		ClientCountryName     string `json:"clientCountryName"`
+		EdgeResponseStatus    int    `json:"edgeResponseStatus"`
+		CacheStatus           string `json:"cacheStatus"`
+		OriginResponseStatus  int    `json:"originResponseStatus"`
+		ClientRequestHTTPHost string `json:"clientRequestHTTPHost"`
+		BotManagementVerdict  string `json:"botManagementVerdict"`
+	} `json:"dimensions"`
+	Sum struct {
+		Requests          int64 `json:"requests"`
+		EdgeResponseBytes int64 `json:"edgeResponseBytes"`
+		ThreatsCount      int64 `json:"threats"`
+	} `json:"sum"`
+}
+
+const httpRequestsAdaptiveGroupsQuery = `
+query($zoneTag: String!, $since: Time!, $until: Time!) {
+  viewer {
+    zones(filter: {zoneTag: $zoneTag}) {
+      httpRequestsAdaptiveGroups(limit: 10000, filter: {datetime_geq: $since, datetime_lt: $until}) {
+        dimensions {
+          clientCountryName
+          edgeResponseStatus
+          cacheStatus
+          originResponseStatus
+          clientRequestHTTPHost
+          botManagementVerdict
+        }
+        sum {
+          requests
+          edgeResponseBytes
+          threats
+        }
+      }
+    }
+  }
+}`
+
+// updateHTTPRequestsAdaptiveGroups exposes request/byte/threat counters
+// broken down by country, status, cache status, host and bot verdict.
+func (cm *CloudflareMetrics) updateHTTPRequestsAdaptiveGroups(zoneId string, zoneName string, since time.Time, until time.Time) {
+	var raw json.RawMessage
+	err := cm.withRateLimit(zoneName, "httpRequestsAdaptiveGroups", func() error {
+		var queryErr error
+		raw, queryErr = cm.graphql.query(httpRequestsAdaptiveGroupsQuery, map[string]interface{}{
+			"zoneTag": zoneId,
+			"since":   since.Format(time.RFC3339),
+			"until":   until.Format(time.RFC3339),
+		})
+		return queryErr
+	})
+	if err != nil {
+		log.Printf("graphqlClient.query(httpRequestsAdaptiveGroups, %v): %v\n", zoneId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	var data zoneAnalyticsResponse
+	if err := json.Unmarshal(raw, &data); err != nil {
+		log.Printf("unmarshal httpRequestsAdaptiveGroups(%v): %v\n", zoneId, err)
+		return
+	}
+	if len(data.Viewer.Zones) == 0 {
+		return
+	}
+
+	labelNames := []string{"country", "status", "cache_status", "origin_status", "host", "bot_verdict"}
+	var requests, bytesOut, threats []multiLabelRow
+
+	for _, group := range data.Viewer.Zones[0].HTTPRequestsAdaptiveGroups {
+		labels := []string{
+			group.Dimensions.ClientCountryName,
+			fmt.Sprintf("%d", group.Dimensions.EdgeResponseStatus),
+			group.Dimensions.CacheStatus,
+			fmt.Sprintf("%d", group.Dimensions.OriginResponseStatus),
+			group.Dimensions.ClientRequestHTTPHost,
+			group.Dimensions.BotManagementVerdict,
+		}
+		requests = append(requests, multiLabelRow{labels, float64(group.Sum.Requests)})
+		bytesOut = append(bytesOut, multiLabelRow{labels, float64(group.Sum.EdgeResponseBytes)})
+		threats = append(threats, multiLabelRow{labels, float64(group.Sum.ThreatsCount)})
+	}
+
+	cm.updateZoneGaugeMulti(zoneId, zoneName, "cloudflare_requests", "Number of requests in the current --cloudflare.since window, by country, status, cache status, origin status, host and bot verdict", labelNames, requests)
+	cm.updateZoneGaugeMulti(zoneId, zoneName, "cloudflare_bandwidth_bytes", "Response bytes in the current --cloudflare.since window, by country, status, cache status, origin status, host and bot verdict", labelNames, bytesOut)
+	cm.updateZoneGaugeMulti(zoneId, zoneName, "cloudflare_threats", "Mitigated threats in the current --cloudflare.since window, by country, status, cache status, origin status, host and bot verdict", labelNames, threats)
+}
+
+type firewallEventsAdaptiveEvent struct {
+	ClientCountryName string `json:"clientCountryName"`
+	Action            string `json:"action"`
+	Source            string `json:"source"`
+}
+
+const firewallEventsAdaptiveQuery = `
+query($zoneTag: String!, $since: Time!, $until: Time!) {
+  viewer {
+    zones(filter: {zoneTag: $zoneTag}) {
+      firewallEventsAdaptive(limit: 10000, filter: {datetime_geq: $since, datetime_lt: $until}) {
+        clientCountryName
+        action
+        source
+      }
+    }
+  }
+}`
+
+// updateFirewallEventsAdaptive exposes a firewall event counter broken down
+// by country, action and rule source. firewallEventsAdaptive is a raw-event
+// dataset (no server-side aggregation), so counts are tallied client-side.
+func (cm *CloudflareMetrics) updateFirewallEventsAdaptive(zoneId string, zoneName string, since time.Time, until time.Time) {
+	var raw json.RawMessage
+	err := cm.withRateLimit(zoneName, "firewallEventsAdaptive", func() error {
+		var queryErr error
+		raw, queryErr = cm.graphql.query(firewallEventsAdaptiveQuery, map[string]interface{}{
+			"zoneTag": zoneId,
+			"since":   since.Format(time.RFC3339),
+			"until":   until.Format(time.RFC3339),
+		})
+		return queryErr
+	})
+	if err != nil {
+		log.Printf("graphqlClient.query(firewallEventsAdaptive, %v): %v\n", zoneId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	var data zoneAnalyticsResponse
+	if err := json.Unmarshal(raw, &data); err != nil {
+		log.Printf("unmarshal firewallEventsAdaptive(%v): %v\n", zoneId, err)
+		return
+	}
+	if len(data.Viewer.Zones) == 0 {
+		return
+	}
+
+	labelNames := []string{"country", "action", "source"}
+	counts := make(map[[3]string]float64)
+	for _, event := range data.Viewer.Zones[0].FirewallEventsAdaptive {
+		counts[[3]string{event.ClientCountryName, event.Action, event.Source}]++
+	}
+
+	var events []multiLabelRow
+	for labels, count := range counts {
+		events = append(events, multiLabelRow{labels[:], count})
+	}
+
+	cm.updateZoneGaugeMulti(zoneId, zoneName, "cloudflare_firewall_events", "Firewall events in the current --cloudflare.since window, by country, action and rule source", labelNames, events)
+}
+
+type healthCheckEventsAdaptiveGroup struct {
+	Dimensions struct {
+		HealthCheckName string `json:"healthCheckName"`
+		OriginIP        string `json:"originIP"`
+		Region          string `json:"region"`
+		HealthStatus    string `json:"healthStatus"`
+		FailureReason   string `json:"failureReason"`
+	} `json:"dimensions"`
+	Count int64 `json:"count"`
+}
+
+const healthCheckEventsAdaptiveGroupsQuery = `
+query($zoneTag: String!, $since: Time!, $until: Time!) {
+  viewer {
+    zones(filter: {zoneTag: $zoneTag}) {
+      healthCheckEventsAdaptiveGroups(limit: 10000, filter: {datetime_geq: $since, datetime_lt: $until}) {
+        dimensions {
+          healthCheckName
+          originIP
+          region
+          healthStatus
+          failureReason
+        }
+        count
+      }
+    }
+  }
+}`
+
+// updateHealthCheckEventsAdaptiveGroups exposes a health check event
+// counter broken down by check name, origin, region and outcome.
+func (cm *CloudflareMetrics) updateHealthCheckEventsAdaptiveGroups(zoneId string, zoneName string, since time.Time, until time.Time) {
+	var raw json.RawMessage
+	err := cm.withRateLimit(zoneName, "healthCheckEventsAdaptiveGroups", func() error {
+		var queryErr error
+		raw, queryErr = cm.graphql.query(healthCheckEventsAdaptiveGroupsQuery, map[string]interface{}{
+			"zoneTag": zoneId,
+			"since":   since.Format(time.RFC3339),
+			"until":   until.Format(time.RFC3339),
+		})
+		return queryErr
+	})
+	if err != nil {
+		log.Printf("graphqlClient.query(healthCheckEventsAdaptiveGroups, %v): %v\n", zoneId, err)
+		cm.recordScrapeError(err)
+		return
+	}
+
+	var data zoneAnalyticsResponse
+	if err := json.Unmarshal(raw, &data); err != nil {
+		log.Printf("unmarshal healthCheckEventsAdaptiveGroups(%v): %v\n", zoneId, err)
+		return
+	}
+	if len(data.Viewer.Zones) == 0 {
+		return
+	}
+
+	labelNames := []string{"health_check_name", "origin_ip", "region", "health_status", "failure_reason"}
+	var events []multiLabelRow
+	for _, group := range data.Viewer.Zones[0].HealthCheckEventsAdaptiveGroups {
+		labels := []string{
+			group.Dimensions.HealthCheckName,
+			group.Dimensions.OriginIP,
+			group.Dimensions.Region,
+			group.Dimensions.HealthStatus,
+			group.Dimensions.FailureReason,
+		}
+		events = append(events, multiLabelRow{labels, float64(group.Count)})
+	}
+
+	cm.updateZoneGaugeMulti(zoneId, zoneName, "cloudflare_health_check_events", "Health check events in the current --cloudflare.since window, by check name, origin, region and outcome", labelNames, events)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	toolkit_web "github.com/prometheus/exporter-toolkit/web"
+)
+
+// Server wraps the exporter's HTTP surface: the Prometheus handler plus the
+// health/readiness endpoints Kubernetes-style deployments expect, and the
+// optional pprof/reload endpoints operators can opt into.
+type Server struct {
+	httpServer *http.Server
+	flagConfig *toolkit_web.FlagConfig
+}
+
+// NewServer builds the exporter's HTTP server. listenAddr is the single
+// address this exporter binds to; webConfigFile, if non-empty, points at a
+// github.com/prometheus/exporter-toolkit web-configuration file enabling TLS
+// or basic auth. metrics is called on every request so a /-/reload can swap
+// in a freshly built *CloudflareMetrics without restarting the server; it
+// may return nil if the legacy single-target flags weren't configured, in
+// which case only /probe (multi-target mode) is usable. multiTarget, if
+// non-nil, enables /probe?target=<name> against the named targets loaded
+// from --config.file.
+func NewServer(listenAddr string, webConfigFile string, metrics func() *CloudflareMetrics, enablePprof bool, enableReload bool, reload func(), multiTarget *MultiTargetConfig) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", scrapeHandler(metrics))
+	mux.HandleFunc("/healthz", healthzHandler(metrics))
+	mux.HandleFunc("/readyz", readyzHandler(metrics))
+
+	if multiTarget != nil {
+		mux.Handle("/probe", probeHandler(multiTarget))
+	}
+
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	if enableReload && reload != nil {
+		mux.HandleFunc("/-/reload", reloadHandler(reload))
+	}
+
+	listenAddrs := []string{listenAddr}
+	return &Server{
+		httpServer: &http.Server{Handler: mux},
+		flagConfig: &toolkit_web.FlagConfig{
+			WebListenAddresses: &listenAddrs,
+			WebSystemdSocket:   boolPtr(false),
+			WebConfigFile:      &webConfigFile,
+		},
+	}
+}
+
+// ListenAndServe blocks serving the exporter's HTTP endpoints until ctx is
+// canceled, at which point it gracefully shuts the server down.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- toolkit_web.ListenAndServe(s.httpServer, s.flagConfig, kitlog.NewNopLogger())
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return s.httpServer.Shutdown(context.Background())
+	}
+}
+
+// scrapeHandler runs one Cloudflare API pass per Prometheus scrape against
+// the legacy single-target *CloudflareMetrics, then renders whatever it
+// collected via a promhttp handler built against that instance's own
+// registry (it can change out from under us via /-/reload).
+func scrapeHandler(metrics func() *CloudflareMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := metrics()
+		if m == nil {
+			http.Error(w, "legacy single-target mode is not configured; set --cloudflare.zones or use /probe?target=<name>", http.StatusNotFound)
+			return
+		}
+		m.update()
+		promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+	}
+}
+
+// probeHandler implements the blackbox/snmp_exporter multi-target pattern:
+// each request builds a fresh CloudflareMetrics (and Prometheus registry)
+// for the named target, scrapes it once, and renders it. Nothing about the
+// target is retained between requests.
+func probeHandler(multiTarget *MultiTargetConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetName := r.URL.Query().Get("target")
+		if targetName == "" {
+			http.Error(w, "target query parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		target, ok := multiTarget.Targets[targetName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", targetName), http.StatusNotFound)
+			return
+		}
+
+		m, err := New(target.exporterConfig())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		m.update()
+		promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+	}
+}
+
+func healthzHandler(metrics func() *CloudflareMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := metrics()
+		if m == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if err := m.Healthy(); err != nil {
+			http.Error(w, "last scrape failed authentication: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func readyzHandler(metrics func() *CloudflareMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := metrics()
+		if m == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if !m.Ready() {
+			http.Error(w, "waiting on first scrape", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func reloadHandler(reload func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "reload must be requested via POST", http.StatusMethodNotAllowed)
+			return
+		}
+		reload()
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -2,25 +2,53 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	cloudflare "github.com/cloudflare/cloudflare-go"
 	prometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"golang.org/x/time/rate"
 )
 
 type CloudflareMetrics struct {
-	api           *cloudflare.API
-	zones         []string
-	accounts      []string
-	since         string
-	includeAccess bool
+	api            *cloudflare.API
+	graphql        *graphqlClient
+	zones          []string
+	accounts       []string
+	since          string
+	includeAccess  bool
+	maxConcurrency int
+	limiter        *rate.Limiter
+
+	// registry is per-instance rather than prometheus.DefaultGatherer so /probe
+	// can build a throwaway CloudflareMetrics per request (see probeHandler in http.go).
+	registry *prometheus.Registry
 
 	counters   map[string]*prometheus.CounterVec
 	gauges     map[string]*prometheus.GaugeVec
 	histograms map[string]*prometheus.HistogramVec
 	summaries  map[string]*prometheus.SummaryVec
+
+	// counterLabels/gaugeLabels record the label key set each metric name was
+	// first registered with, so a later call with a different set of keys
+	// (e.g. two scopes reusing one metric name) fails loudly at registration
+	// instead of panicking deep inside GaugeVec/CounterVec.With.
+	counterLabels map[string][]string
+	gaugeLabels   map[string][]string
+
+	mu          sync.Mutex
+	updated     bool
+	lastAuthErr error
+
+	// scrapeMu serializes update() calls against this instance so overlapping
+	// scrapes can't race on resetGauges().
+	scrapeMu sync.Mutex
 }
 
 var (
@@ -81,128 +109,309 @@ func newWithUserServiceKeyAuth(config ExporterConfig) (*CloudflareMetrics, error
 }
 
 func newWithAPI(cloudflareApi *cloudflare.API, config ExporterConfig) *CloudflareMetrics {
+	maxConcurrency := config.cloudflareMaxConcurrency
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector())
+	registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
 	return &CloudflareMetrics{
-		api:           cloudflareApi,
-		zones:         strings.Split(strings.ReplaceAll(config.cloudflareZones, " ", ""), ","),
-		accounts:      strings.Split(strings.ReplaceAll(config.cloudflareAccounts, " ", ""), ","),
-		since:         config.cloudflareSince,
-		includeAccess: config.cloudflareIncludeAccess,
-		counters:      map[string]*prometheus.CounterVec{},
-		gauges:        map[string]*prometheus.GaugeVec{},
-		histograms:    map[string]*prometheus.HistogramVec{},
-		summaries:     map[string]*prometheus.SummaryVec{},
+		api:            cloudflareApi,
+		graphql:        newGraphQLClient(cloudflareApi, config.cloudflareGraphQLDatasets),
+		zones:          strings.Split(strings.ReplaceAll(config.cloudflareZones, " ", ""), ","),
+		accounts:       strings.Split(strings.ReplaceAll(config.cloudflareAccounts, " ", ""), ","),
+		since:          config.cloudflareSince,
+		includeAccess:  config.cloudflareIncludeAccess,
+		maxConcurrency: maxConcurrency,
+		limiter:        rate.NewLimiter(cloudflareAPIRateLimit, cloudflareAPIRateLimitBurst),
+		registry:       registry,
+		counters:       map[string]*prometheus.CounterVec{},
+		gauges:         map[string]*prometheus.GaugeVec{},
+		histograms:     map[string]*prometheus.HistogramVec{},
+		summaries:      map[string]*prometheus.SummaryVec{},
+		counterLabels:  map[string][]string{},
+		gaugeLabels:    map[string][]string{},
 	}
 }
 
+// update scrapes every configured zone and account, bounding concurrency to
+// maxConcurrency so a tenant with dozens of zones doesn't serialize past
+// Prometheus's scrape timeout. Each zone/account scrape is independent, so a
+// slow or failing one can't block the rest.
 func (cm *CloudflareMetrics) update() {
-	if cm.includeAccess == true {
-		for _, account := range cm.accounts {
-			cm.updateAccount(account)
+	cm.scrapeMu.Lock()
+	defer cm.scrapeMu.Unlock()
+
+	cm.resetGauges()
+
+	sem := make(chan struct{}, cm.maxConcurrency)
+	var wg sync.WaitGroup
+
+	runScrape := func(label string, scrape func()) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			scrape()
+			cm.recordScrapeDuration(label, time.Since(start))
+		}()
+	}
+
+	for _, account := range cm.accounts {
+		if account == "" {
+			continue
 		}
+		account := account
+		runScrape(account, func() {
+			if cm.includeAccess {
+				cm.updateAccount(account)
+			}
+			cm.updateAccountRulesets(account)
+		})
 	}
 	for _, zone := range cm.zones {
-		cm.updateZone(zone)
+		zone := zone
+		runScrape(zone, func() {
+			cm.updateZone(zone)
+		})
 	}
+
+	wg.Wait()
+
+	cm.mu.Lock()
+	cm.updated = true
+	cm.mu.Unlock()
 }
 
-func (cm *CloudflareMetrics) updateAccount(accountId string) {
-	serviceTokenExpirationMap := make(map[string]int64)
+// recordScrapeDuration exports how long one zone/account's scrape took, so
+// slow tenants are visible before they cause a Prometheus scrape timeout.
+func (cm *CloudflareMetrics) recordScrapeDuration(target string, duration time.Duration) {
+	labels := prometheus.Labels{"target": target}
+	cm.createGaugeIfNotExists("cloudflare_exporter_scrape_duration_seconds", "Duration of the most recent scrape of a single zone or account, in seconds", labels).With(labels).Set(duration.Seconds())
+}
 
-	accessServiceTokens, _, err := cm.api.AccessServiceTokens(accountId)
-	if err != nil {
-		log.Printf("cloudflare.API.AccessServiceTokens(%v): %v\n", accountId, err)
-		return
+// recordScrapeError remembers the most recent Cloudflare API error so
+// /healthz can report it; a subsequent successful call clears it.
+func (cm *CloudflareMetrics) recordScrapeError(err error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if isAuthError(err) {
+		cm.lastAuthErr = err
+	} else {
+		cm.lastAuthErr = nil
 	}
-	for _, data := range accessServiceTokens {
-		serviceTokenExpirationMap[data.Name] = data.ExpiresAt.Unix()
+}
+
+// httpStatusError is implemented by both cloudflare.APIRequestError and our
+// own graphqlHTTPError, letting recordScrapeError recognize a 401/403 from
+// either the REST or the GraphQL API.
+type httpStatusError interface {
+	HTTPStatusCode() int
+}
+
+func isAuthError(err error) bool {
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.HTTPStatusCode() == http.StatusUnauthorized || statusErr.HTTPStatusCode() == http.StatusForbidden
 	}
+	return false
+}
+
+// Healthy reports the last auth-related scrape error, if any.
+func (cm *CloudflareMetrics) Healthy() error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.lastAuthErr
+}
+
+// Ready reports whether update() has completed at least once.
+func (cm *CloudflareMetrics) Ready() bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.updated
+}
 
-	cm.updateAccountGaugeByLabel(accountId, "access_service_token_expiration", "The current unix timestamp at which a service token expires", "token_name", serviceTokenExpirationMap)
+// updateAccount exports the account's Access observability layer: service
+// tokens, applications (and their policies), identity providers, and org
+// settings.
+func (cm *CloudflareMetrics) updateAccount(accountId string) {
+	cm.updateAccountAccessServiceTokens(accountId)
+	cm.updateAccountAccessApplications(accountId)
+	cm.updateAccountAccessIdentityProviders(accountId)
+	cm.updateAccountAccessOrganization(accountId)
 }
 
 func (cm *CloudflareMetrics) updateZone(zoneName string) {
-	zoneId, err := cm.api.ZoneIDByName(zoneName)
+	var zoneId string
+	err := cm.withRateLimit(zoneName, "ZoneIDByName", func() error {
+		var apiErr error
+		zoneId, apiErr = cm.api.ZoneIDByName(zoneName)
+		return apiErr
+	})
 	if err != nil {
 		log.Printf("cloudflare.API.ZoneIDByName(%v): %v\n", zoneName, err)
+		cm.recordScrapeError(err)
 		return
 	}
 
+	cm.updateZoneGraphQL(zoneId, zoneName)
+	cm.updateZoneRulesets(zoneId, zoneName)
+}
+
+// updateZoneGraphQL pulls each dataset named in --cloudflare.graphql-datasets
+// from Cloudflare's GraphQL Analytics API. Unlike the old ZoneAnalyticsDashboard
+// gauges, these metric names are stable: the scrape window is a query
+// parameter, not part of the name, so it no longer breaks recording rules
+// when --cloudflare.since changes.
+func (cm *CloudflareMetrics) updateZoneGraphQL(zoneId string, zoneName string) {
 	duration := "-" + cm.since
-	since, err := time.ParseDuration(duration)
+	sinceOffset, err := time.ParseDuration(duration)
 	if err != nil {
 		log.Printf("time.ParseDuration(%v): %v\n", duration, err)
 		return
 	}
-
-	optionSince := time.Now().Add(since)
-	optionContinuous := false
-	data, err := cm.api.ZoneAnalyticsDashboard(zoneId, cloudflare.ZoneAnalyticsOptions{Since: &optionSince, Continuous: &optionContinuous})
-	if err != nil {
-		log.Printf("cloudflare.API.ZoneAnalyticsDashboard(%v): %v\n", zoneId, err)
-		return
+	until := time.Now()
+	since := until.Add(sinceOffset)
+
+	for _, dataset := range cm.graphql.datasets {
+		switch dataset {
+		case "httpRequestsAdaptiveGroups":
+			cm.updateHTTPRequestsAdaptiveGroups(zoneId, zoneName, since, until)
+		case "firewallEventsAdaptive":
+			cm.updateFirewallEventsAdaptive(zoneId, zoneName, since, until)
+		case "healthCheckEventsAdaptiveGroups":
+			cm.updateHealthCheckEventsAdaptiveGroups(zoneId, zoneName, since, until)
+		default:
+			log.Printf("unknown cloudflare.graphql-datasets entry %q\n", dataset)
+		}
 	}
-
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_requests_rate"+cm.since, "Total number of requests over the last 24h", data.Totals.Requests.All)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_requests_cached_rate"+cm.since, "Total number of cached requests over the last 24h", data.Totals.Requests.Cached)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_requests_uncached_rate"+cm.since, "Total number of uncached requests over the last 24h", data.Totals.Requests.Uncached)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_requests_content_type_rate"+cm.since, "Total number of requests over the last 24h by response Content-Type header", "content_type", data.Totals.Requests.ContentType)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_requests_country_rate"+cm.since, "Total number of requests over the last 24h by request country", "country", data.Totals.Requests.Country)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_requests_encrypted_rate"+cm.since, "Total number of encrypted requests over the last 24h", data.Totals.Requests.SSL.Encrypted)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_requests_unencrypted_rate"+cm.since, "Total number of unencrypted requests over the last 24h", data.Totals.Requests.SSL.Unencrypted)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_requests_status_rate"+cm.since, "Total number of requests over the last 24h by response code", "status", data.Totals.Requests.HTTPStatus)
-
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_bandwidth_bytes_rate"+cm.since, "Total bandwidth over the last 24h", data.Totals.Bandwidth.All)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_bandwidth_cached_bytes_rate"+cm.since, "Total cached bandwidth over the last 24h", data.Totals.Bandwidth.Cached)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_bandwidth_uncached_bytes_rate"+cm.since, "Total uncached bandwidth over the last 24h", data.Totals.Bandwidth.Uncached)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_bandwidth_content_type_bytes_rate"+cm.since, "Total bandwidth over the last 24h by response Content-Type header", "content_type", data.Totals.Bandwidth.ContentType)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_bandwidth_country_bytes_rate"+cm.since, "Total bandwidth over the last 24h by request country", "country", data.Totals.Bandwidth.Country)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_bandwidth_encrypted_bytes_rate"+cm.since, "Total encrypted bandwidth over the last 24h", data.Totals.Bandwidth.SSL.Encrypted)
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_bandwidth_unencrypted_bytes_rate"+cm.since, "Total unencrypted bandwidth over the last 24h", data.Totals.Bandwidth.SSL.Unencrypted)
-
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_threats_rate"+cm.since, "Total mitigated threats over the last 24h", data.Totals.Threats.All)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_threats_country_rate"+cm.since, "Total mitigated threats over the last 24h by request country", "country", data.Totals.Threats.Country)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_threats_type_rate"+cm.since, "Total mitigated threats over the last 24h by type", "type", data.Totals.Threats.Type)
-
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_pageviews_rate"+cm.since, "Total page views over the last 24h", data.Totals.Pageviews.All)
-	cm.updateZoneGaugeByLabel(zoneId, zoneName, "cloudflare_pageviews_search_engine_rate"+cm.since, "Total page views over the last 24h by search engine", "search_engine", data.Totals.Pageviews.SearchEngines)
-
-	cm.updateZoneGauge(zoneId, zoneName, "cloudflare_uniques_rate"+cm.since, "Total unique visitors over the last 24h", data.Totals.Uniques.All)
 }
 
 func (cm *CloudflareMetrics) updateZoneGauge(zoneId string, zoneName string, name string, help string, value int) {
 	labels := prometheus.Labels{"zone_id": zoneId, "zone_name": zoneName}
-	cm.createGaugeIfNotExists(name, help, labels)
-	cm.gauges[name].With(labels).Set(float64(value))
+	cm.createGaugeIfNotExists(name, help, labels).With(labels).Set(float64(value))
 }
 
 func (cm *CloudflareMetrics) updateZoneGaugeByLabel(zoneId string, zoneName string, name string, help string, byLabel string, values map[string]int) {
 	labels := prometheus.Labels{"zone_id": zoneId, "zone_name": zoneName, byLabel: ""}
-	cm.createGaugeIfNotExists(name, help, labels)
+	gauge := cm.createGaugeIfNotExists(name, help, labels)
 	for key, value := range values {
 		labels[byLabel] = key
-		cm.gauges[name].With(labels).Set(float64(value))
+		gauge.With(labels).Set(float64(value))
 	}
 }
 
 func (cm *CloudflareMetrics) updateAccountGaugeByLabel(accountId string, name string, help string, byLabel string, values map[string]int64) {
 	labels := prometheus.Labels{"account_id": accountId, byLabel: ""}
-	cm.createGaugeIfNotExists(name, help, labels)
+	gauge := cm.createGaugeIfNotExists(name, help, labels)
 	for key, value := range values {
 		labels[byLabel] = key
-		cm.gauges[name].With(labels).Set(float64(value))
+		gauge.With(labels).Set(float64(value))
 	}
 }
 
-func (cm *CloudflareMetrics) createGaugeIfNotExists(name string, help string, labels prometheus.Labels) {
-	if _, ok := cm.gauges[name]; !ok {
-		label_names := make([]string, len(labels))
-		i := 0
-		for label := range labels {
-			label_names[i] = label
-			i++
+// multiLabelRow is one data point from a GraphQL Analytics query: a value
+// together with the dimension values it was grouped by, in the same order
+// as the labelNames passed to updateZoneGaugeMulti.
+type multiLabelRow struct {
+	labels []string
+	value  float64
+}
+
+// updateZoneGaugeMulti is the GraphQL-dataset counterpart of
+// updateZoneGaugeByLabel: it declares a gauge with zone_id, zone_name and an
+// arbitrary number of caller-supplied dimension labels, then fills it in
+// from a set of rows already grouped by the Cloudflare API.
+func (cm *CloudflareMetrics) updateZoneGaugeMulti(zoneId string, zoneName string, name string, help string, labelNames []string, rows []multiLabelRow) {
+	labels := prometheus.Labels{"zone_id": zoneId, "zone_name": zoneName}
+	for _, labelName := range labelNames {
+		labels[labelName] = ""
+	}
+	gauge := cm.createGaugeIfNotExists(name, help, labels)
+
+	for _, row := range rows {
+		for i, labelName := range labelNames {
+			labels[labelName] = row.labels[i]
 		}
+		gauge.With(labels).Set(row.value)
+	}
+}
+
+// createGaugeIfNotExists returns the registered GaugeVec for name, creating
+// and registering it first if this is the first time it's been seen. It
+// panics if name was previously registered with a different label key set,
+// since GaugeVec.With would otherwise panic anyway on the first mismatched
+// call, deeper in the stack and harder to attribute to its cause.
+func (cm *CloudflareMetrics) createGaugeIfNotExists(name string, help string, labels prometheus.Labels) *prometheus.GaugeVec {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	names := labelNames(labels)
+	if gauge, ok := cm.gauges[name]; ok {
+		assertLabelNamesMatch(name, cm.gaugeLabels[name], names)
+		return gauge
+	}
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, names)
+	cm.registry.MustRegister(gauge)
+	cm.gauges[name] = gauge
+	cm.gaugeLabels[name] = names
+	return gauge
+}
+
+// createCounterIfNotExists is the CounterVec counterpart of createGaugeIfNotExists.
+func (cm *CloudflareMetrics) createCounterIfNotExists(name string, help string, labels prometheus.Labels) *prometheus.CounterVec {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	names := labelNames(labels)
+	if counter, ok := cm.counters[name]; ok {
+		assertLabelNamesMatch(name, cm.counterLabels[name], names)
+		return counter
+	}
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, names)
+	cm.registry.MustRegister(counter)
+	cm.counters[name] = counter
+	cm.counterLabels[name] = names
+	return counter
+}
+
+// assertLabelNamesMatch panics with a message naming the offending metric if
+// got doesn't match want; both are assumed already sorted by labelNames.
+func assertLabelNamesMatch(name string, want []string, got []string) {
+	if len(want) != len(got) {
+		panic(fmt.Sprintf("metric %v: inconsistent label sets %v vs %v", name, want, got))
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			panic(fmt.Sprintf("metric %v: inconsistent label sets %v vs %v", name, want, got))
+		}
+	}
+}
+
+// labelNames returns labels' keys in sorted order, for deterministic metric output.
+func labelNames(labels prometheus.Labels) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-		cm.gauges[name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, label_names)
-		prometheus.MustRegister(cm.gauges[name])
+// resetGauges clears every gauge so stale label combinations from a prior
+// scrape don't linger; counters are untouched.
+func (cm *CloudflareMetrics) resetGauges() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, gauge := range cm.gauges {
+		gauge.Reset()
 	}
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// cloudflareAPIRateLimit approximates Cloudflare's documented
+	// account-wide API rate limit of 1200 requests per 5 minutes.
+	cloudflareAPIRateLimit      = rate.Limit(1200.0 / 300.0)
+	cloudflareAPIRateLimitBurst = 10
+
+	maxAPIAttempts    = 4
+	initialAPIBackoff = 500 * time.Millisecond
+)
+
+// withRateLimit waits for a token from cm's limiter, then calls fn, retrying
+// with exponential backoff and jitter if fn fails with a 429 or 5xx. target
+// identifies the zone or account the call is scoped to, and endpoint the
+// Cloudflare API method being called; both are used purely for labeling the
+// cloudflare_exporter_* metrics below.
+func (cm *CloudflareMetrics) withRateLimit(target string, endpoint string, fn func() error) error {
+	var err error
+	backoff := initialAPIBackoff
+
+	for attempt := 1; attempt <= maxAPIAttempts; attempt++ {
+		if waitErr := cm.limiter.Wait(context.Background()); waitErr != nil {
+			return waitErr
+		}
+		cm.recordRateLimitRemaining()
+
+		err = fn()
+		cm.recordAPIRequest(endpoint, err)
+
+		if err == nil {
+			// A successful call clears any auth error an earlier one recorded.
+			cm.recordScrapeError(nil)
+			return nil
+		}
+		if !isNotFoundError(err) {
+			cm.recordScrapeErrorMetric(target, endpoint)
+		}
+
+		if !isRetryableError(err) || attempt == maxAPIAttempts {
+			return err
+		}
+
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+
+	return err
+}
+
+// recordAPIRequest counts every Cloudflare API call the exporter makes, by
+// endpoint and response code, so operators can correlate missing metrics
+// with rate limiting.
+func (cm *CloudflareMetrics) recordAPIRequest(endpoint string, err error) {
+	code := "200"
+	var statusErr httpStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		code = strconv.Itoa(statusErr.HTTPStatusCode())
+	case err != nil:
+		code = "error"
+	}
+
+	labels := prometheus.Labels{"endpoint": endpoint, "code": code}
+	cm.createCounterIfNotExists("cloudflare_exporter_api_requests_total", "Total Cloudflare API requests made by the exporter, by endpoint and response code", labels).With(labels).Inc()
+}
+
+// recordScrapeErrorMetric counts failed Cloudflare API calls by target (zone
+// or account) and endpoint, independently of recordScrapeError's auth-error
+// tracking used by /healthz.
+func (cm *CloudflareMetrics) recordScrapeErrorMetric(target string, endpoint string) {
+	labels := prometheus.Labels{"target": target, "endpoint": endpoint}
+	cm.createCounterIfNotExists("cloudflare_exporter_scrape_errors_total", "Total failed Cloudflare API calls, by target (zone or account) and endpoint", labels).With(labels).Inc()
+}
+
+// recordRateLimitRemaining exports the limiter's current token count so
+// operators can see scrapes approaching Cloudflare's rate limit.
+func (cm *CloudflareMetrics) recordRateLimitRemaining() {
+	labels := prometheus.Labels{}
+	cm.createGaugeIfNotExists("cloudflare_exporter_rate_limit_remaining", "Tokens remaining in the exporter's Cloudflare API rate limiter", labels).With(labels).Set(cm.limiter.Tokens())
+}
+
+func isRetryableError(err error) bool {
+	var statusErr httpStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	code := statusErr.HTTPStatusCode()
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// isNotFoundError reports whether err is a 404 from the Cloudflare API,
+// which for endpoints like GetZoneRulesetPhase just means the resource
+// (e.g. a ruleset phase) isn't configured, not that the request failed.
+func isNotFoundError(err error) bool {
+	var statusErr httpStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.HTTPStatusCode() == http.StatusNotFound
+}
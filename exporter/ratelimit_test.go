@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type fakeStatusError struct{ code int }
+
+func (e fakeStatusError) Error() string       { return "fake status error" }
+func (e fakeStatusError) HTTPStatusCode() int { return e.code }
+
+func TestIsRetryableError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"429 is retryable", fakeStatusError{http.StatusTooManyRequests}, true},
+		{"500 is retryable", fakeStatusError{http.StatusInternalServerError}, true},
+		{"503 is retryable", fakeStatusError{http.StatusServiceUnavailable}, true},
+		{"404 is not retryable", fakeStatusError{http.StatusNotFound}, false},
+		{"400 is not retryable", fakeStatusError{http.StatusBadRequest}, false},
+		{"non-status error is not retryable", errors.New("boom"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isRetryableError(c.err); got != c.want {
+				t.Errorf("isRetryableError(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestIsNotFoundError(t *testing.T) {
+	if !isNotFoundError(fakeStatusError{http.StatusNotFound}) {
+		t.Error("expected a 404 status error to be reported as not-found")
+	}
+	if isNotFoundError(fakeStatusError{http.StatusInternalServerError}) {
+		t.Error("expected a 500 status error not to be reported as not-found")
+	}
+	if isNotFoundError(errors.New("boom")) {
+		t.Error("expected a non-status error not to be reported as not-found")
+	}
+}
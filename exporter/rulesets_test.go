@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestMetrics(t *testing.T) *CloudflareMetrics {
+	t.Helper()
+	api, err := cloudflare.New("test-key", "test@example.com")
+	if err != nil {
+		t.Fatalf("cloudflare.New: %v", err)
+	}
+	return newWithAPI(api, ExporterConfig{cloudflareZones: "example.com"})
+}
+
+func testRuleset() cloudflare.Ruleset {
+	return cloudflare.Ruleset{
+		ID:    "rs1",
+		Phase: "http_request_firewall_custom",
+		Rules: []cloudflare.RulesetRule{
+			{ID: "rule1", Enabled: true, Action: "block", Description: "test rule"},
+		},
+	}
+}
+
+// Zone-scoped and account-scoped rulesets register the same metric prefix
+// family with different label key sets (zone_id/zone_name vs account_id);
+// they must publish under distinct metric names or the second scope's
+// gauge registration panics.
+func TestUpdateRulesetGaugesZoneAndAccountDontCollide(t *testing.T) {
+	cm := newTestMetrics(t)
+	ruleset := testRuleset()
+
+	cm.updateRulesetGauges("cloudflare_ruleset", prometheus.Labels{"zone_id": "z1", "zone_name": "example.com"}, ruleset.Phase, ruleset)
+	cm.updateRulesetGauges("cloudflare_account_ruleset", prometheus.Labels{"account_id": "a1"}, ruleset.Phase, ruleset)
+}
+
+func TestCreateGaugeIfNotExistsPanicsOnLabelMismatch(t *testing.T) {
+	cm := newTestMetrics(t)
+	cm.createGaugeIfNotExists("test_metric", "help", prometheus.Labels{"a": ""})
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected createGaugeIfNotExists to panic on a label-set mismatch")
+		}
+	}()
+	cm.createGaugeIfNotExists("test_metric", "help", prometheus.Labels{"b": ""})
+}
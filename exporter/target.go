@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TargetConfig is one named Cloudflare tenant to scrape, as listed under
+// "targets" in the --config.file multi-target YAML file. Its fields mirror
+// ExporterConfig's scrape-affecting fields (see ExporterConfig).
+type TargetConfig struct {
+	Email           string `yaml:"email"`
+	Key             string `yaml:"key"`
+	Token           string `yaml:"token"`
+	UserServiceKey  string `yaml:"user_service_key"`
+	Zones           string `yaml:"zones"`
+	Accounts        string `yaml:"accounts"`
+	Since           string `yaml:"since"`
+	IncludeAccess   bool   `yaml:"include_access"`
+	GraphQLDatasets string `yaml:"graphql_datasets"`
+	MaxConcurrency  int    `yaml:"max_concurrency"`
+}
+
+// MultiTargetConfig is the top-level shape of --config.file: a named set of
+// Cloudflare tenants, so one exporter process can serve
+// /probe?target=<name> for each of them instead of running one exporter per
+// tenant (the blackbox/snmp_exporter multi-target pattern).
+type MultiTargetConfig struct {
+	Targets map[string]TargetConfig `yaml:"targets"`
+}
+
+func loadMultiTargetConfig(path string) (*MultiTargetConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %v: %w", path, err)
+	}
+
+	var config MultiTargetConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse %v: %w", path, err)
+	}
+	return &config, nil
+}
+
+// exporterConfig converts a named target into the same ExporterConfig shape
+// New() already knows how to build a CloudflareMetrics from, applying the
+// same defaults the single-target --cloudflare.* flags do.
+func (t TargetConfig) exporterConfig() ExporterConfig {
+	since := t.Since
+	if since == "" {
+		since = "24h"
+	}
+
+	datasets := t.GraphQLDatasets
+	if datasets == "" {
+		datasets = "httpRequestsAdaptiveGroups,firewallEventsAdaptive,healthCheckEventsAdaptiveGroups"
+	}
+
+	maxConcurrency := t.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = 4
+	}
+
+	return ExporterConfig{
+		cloudflareEmail:           t.Email,
+		cloudflareKey:             t.Key,
+		cloudflareToken:           t.Token,
+		cloudflareUserServiceKey:  t.UserServiceKey,
+		cloudflareZones:           t.Zones,
+		cloudflareAccounts:        t.Accounts,
+		cloudflareSince:           since,
+		cloudflareIncludeAccess:   t.IncludeAccess,
+		cloudflareGraphQLDatasets: datasets,
+		cloudflareMaxConcurrency:  maxConcurrency,
+	}
+}